@@ -0,0 +1,86 @@
+// +build linux
+
+// Package netstate snapshots the parts of the host's networking
+// configuration pin is about to mutate, so a crashed or interrupted pin can
+// restore them instead of leaving the user with a broken default route.
+package netstate
+
+import (
+	"github.com/vishvananda/netlink"
+)
+
+// NetState is a point-in-time snapshot captured before pin's setup code
+// touches routes or addresses.
+type NetState struct {
+	ifaceName     string
+	defaultRoutes []netlink.Route
+	tunAddrs      []netlink.Addr
+}
+
+// Capture records the host's current default route(s) and any addresses
+// already present on ifaceName (normally none, since the tun interface was
+// just created, but pin should not assume that).
+func Capture(ifaceName string) (*NetState, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+
+	var defaultRoutes []netlink.Route
+	for _, r := range routes {
+		if r.Dst == nil {
+			defaultRoutes = append(defaultRoutes, r)
+		}
+	}
+
+	state := &NetState{ifaceName: ifaceName, defaultRoutes: defaultRoutes}
+
+	if link, err := netlink.LinkByName(ifaceName); err == nil {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, err
+		}
+		state.tunAddrs = addrs
+	}
+
+	return state, nil
+}
+
+// Restore removes any address left on ifaceName that wasn't there at
+// Capture time and re-installs the default route(s) Capture saw, undoing
+// the /1 override routes a full-tunnel client installs.
+func (s *NetState) Restore() error {
+	link, err := netlink.LinkByName(s.ifaceName)
+	if err == nil {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return err
+		}
+		for _, a := range addrs {
+			if !s.hadAddr(a) {
+				addr := a
+				if err := netlink.AddrDel(link, &addr); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, r := range s.defaultRoutes {
+		route := r
+		if err := netlink.RouteReplace(&route); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *NetState) hadAddr(a netlink.Addr) bool {
+	for _, orig := range s.tunAddrs {
+		if orig.Equal(a) {
+			return true
+		}
+	}
+	return false
+}
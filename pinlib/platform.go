@@ -0,0 +1,58 @@
+package pinlib
+
+import "net"
+
+// PlatformSetup abstracts the OS-specific commands needed to bring up a tun
+// interface, route traffic into it, and NAT it, so the same client/server
+// setup logic in package main runs unmodified on every supported OS.
+// Per-OS implementations live in setup_<os>.go, selected by build tags.
+type PlatformSetup interface {
+	// SetupLink brings the named interface up and sets its MTU.
+	SetupLink(name string, mtu int) error
+	// SetupAddr assigns addr to the named interface, with peer set as the
+	// point-to-point remote address when it isn't empty.
+	SetupAddr(name, addr, peer string) error
+	// AddRoute routes dst via gw. table is the routing table to use; 0
+	// means the platform's default/main table.
+	AddRoute(dst *net.IPNet, gw net.IP, table int) error
+	// InstallNAT makes traffic arriving on iface masquerade as egress when
+	// it leaves the host.
+	InstallNAT(iface, egress string) error
+	// PinRemoteHost installs a host route to addr via the current default
+	// gateway, so the control connection itself isn't pulled into routes
+	// AddRoute installs afterwards.
+	PinRemoteHost(addr string) error
+	// Teardown undoes everything the other methods set up.
+	Teardown() error
+}
+
+// FirewallPolicy controls the firewall rules an InstallNAT call installs
+// alongside the default accept-and-masquerade ruleset, letting pin be
+// locked down beyond a blanket policy. Not every PlatformSetup honours
+// every field; implementations that don't support a field should ignore it
+// rather than error.
+type FirewallPolicy struct {
+	AllowedCIDRs    []*net.IPNet
+	DeniedCIDRs     []*net.IPNet
+	ClientIsolation bool
+	EgressInterface string
+	NoMasquerade    bool
+}
+
+// PolicyRouter is an optional PlatformSetup extra for platforms that support
+// fwmark-based policy routing: marking tun traffic and diverting it into a
+// dedicated routing table so pin's routes don't fight wireguard/tailscale/
+// other VPNs over the main table. SetupClient/SetupServer type-assert for it
+// when asked to enable policy routing; platforms that don't implement it
+// cause that request to fail rather than silently keep routes in the main
+// table.
+type PolicyRouter interface {
+	// EnablePolicyRouting marks pin's own remote connection and installs a
+	// rule that diverts everything else (i.e. unmarked traffic) into
+	// PolicyRouteTable, so pin's own traffic isn't pulled into the table it
+	// just diverted the rest of the host's traffic into.
+	EnablePolicyRouting() error
+	// PolicyRouteTable returns the routing table EnablePolicyRouting
+	// diverts marked traffic into.
+	PolicyRouteTable() int
+}
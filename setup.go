@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"./pinlib"
+)
+
+// This file contains the OS-agnostic setup logic shared by every platform.
+// The actual interface-with-the-kernel work is delegated to a
+// pinlib.PlatformSetup implementation, built per-OS in setup_<os>.go.
+
+// isIPv6 reports whether ip is an IPv6 address (as opposed to an IPv4 or
+// IPv4-in-IPv6 address).
+func isIPv6(ip net.IP) bool {
+	return ip.To4() == nil && ip.To16() != nil
+}
+
+func hostMask(ip net.IP) net.IPMask {
+	if isIPv6(ip) {
+		return net.CIDRMask(128, 128)
+	}
+	return net.CIDRMask(32, 32)
+}
+
+func resolveGw(remotegw string) (net.IP, error) {
+	gw, err := net.ResolveIPAddr("ip4", remotegw)
+	if err != nil || gw.IP.To4() == nil {
+		gw, err = net.ResolveIPAddr("ip6", remotegw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return gw.IP, nil
+}
+
+func defaultRouteOverride(gw net.IP) (lower, upper *net.IPNet) {
+	if isIPv6(gw) {
+		return &net.IPNet{IP: net.ParseIP("::"), Mask: net.CIDRMask(1, 128)},
+			&net.IPNet{IP: net.ParseIP("8000::"), Mask: net.CIDRMask(1, 128)}
+	}
+	return &net.IPNet{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(1, 32)},
+		&net.IPNet{IP: net.IPv4(128, 0, 0, 0), Mask: net.CIDRMask(1, 32)}
+}
+
+// setupRoutes installs the routes that send traffic into the tunnel via
+// remotegw, into table (0 meaning the platform's main table). With no
+// splitCIDRs it installs the split default route (0.0.0.0/1 + 128.0.0.0/1
+// for IPv4, ::/1 + 8000::/1 for IPv6), preserving the physical default route
+// while still capturing all traffic. With splitCIDRs it installs a route
+// per CIDR instead, for a split-tunnel setup that only routes those
+// networks through pin.
+func setupRoutes(ps pinlib.PlatformSetup, remotegw string, splitCIDRs []*net.IPNet, table int) error {
+	gw, err := resolveGw(remotegw)
+	if err != nil {
+		return err
+	}
+
+	if len(splitCIDRs) > 0 {
+		for _, cidr := range splitCIDRs {
+			if err := ps.AddRoute(cidr, gw, table); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	lower, upper := defaultRouteOverride(gw)
+
+	if err := ps.AddRoute(lower, gw, table); err != nil {
+		return err
+	}
+	return ps.AddRoute(upper, gw, table)
+}
+
+// enablePolicyRouting type-asserts ps to pinlib.PolicyRouter and turns on
+// fwmark-based policy routing, returning the table tunnel routes should be
+// installed into. It errors rather than silently falling back when ps
+// doesn't support it, since the caller explicitly asked for it.
+func enablePolicyRouting(ps pinlib.PlatformSetup) (int, error) {
+	pr, ok := ps.(pinlib.PolicyRouter)
+	if !ok {
+		return 0, fmt.Errorf("policy routing was requested but this platform does not support it")
+	}
+	if err := pr.EnablePolicyRouting(); err != nil {
+		return 0, err
+	}
+	return pr.PolicyRouteTable(), nil
+}
+
+// SetupClient wires client.Hook/StopHook to bring up the tunnel on connect
+// and tear it down on stop, using ps for every OS-specific step. splitCIDRs,
+// when non-empty, switches setupRoutes into split-tunnel mode so only those
+// networks are routed through pin instead of overriding the default route.
+// policyRouting, when true, marks pin's own remote connection and installs
+// the tunnel routes into ps's dedicated policy-routing table instead of the
+// main table, diverting everything else into that table too so pin
+// coexists with other VPNs on the same host.
+func SetupClient(client *pinlib.Client, ps pinlib.PlatformSetup, addr, ifaceName, tunaddr, gw string, splitCIDRs []*net.IPNet, policyRouting bool) {
+	client.Hook = func() error {
+		if err := ps.PinRemoteHost(addr); err != nil {
+			return err
+		}
+
+		if err := ps.SetupLink(ifaceName, 1500); err != nil {
+			return err
+		}
+
+		if err := ps.SetupAddr(ifaceName, tunaddr, gw); err != nil {
+			return err
+		}
+
+		table := 0
+		if policyRouting {
+			t, err := enablePolicyRouting(ps)
+			if err != nil {
+				return err
+			}
+			table = t
+		}
+
+		return setupRoutes(ps, gw, splitCIDRs, table)
+	}
+
+	client.StopHook = ps.Teardown
+}
+
+// SetupServer brings up ifaceName and installs NAT for it via ps.
+// Policy routing has no SetupServer flag: it diverts a host's own tunnel
+// routes into a dedicated table, and a server doesn't install any (routing
+// decisions for tunneled traffic are made by the client), so there's
+// nothing for it to do here.
+func SetupServer(server *pinlib.Server, ps pinlib.PlatformSetup, ifaceName, tunaddr, egress string) error {
+	if err := ps.SetupLink(ifaceName, 1500); err != nil {
+		return err
+	}
+
+	if err := ps.SetupAddr(ifaceName, tunaddr, ""); err != nil {
+		return err
+	}
+
+	if err := ps.InstallNAT(ifaceName, egress); err != nil {
+		return err
+	}
+
+	server.StopHook = ps.Teardown
+
+	return nil
+}
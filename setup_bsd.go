@@ -0,0 +1,114 @@
+// +build freebsd openbsd netbsd dragonfly
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"./pinlib"
+)
+
+// This file implements pinlib.PlatformSetup for the BSDs using ifconfig and
+// route for links/addresses/routes, and pf with a dedicated anchor for NAT,
+// the same approach as setup_darwin.go (Darwin's network stack is itself a
+// BSD derivative).
+
+const bsdPfAnchor = "pin"
+
+// bsdSetup implements pinlib.PlatformSetup for FreeBSD/OpenBSD/NetBSD/
+// DragonFly BSD.
+type bsdSetup struct {
+	ifaceName  string
+	remoteAddr string
+	routes     []*net.IPNet
+	natLoaded  bool
+}
+
+// NewBSDSetup returns a pinlib.PlatformSetup backed by ifconfig, route and
+// pf.
+func NewBSDSetup() pinlib.PlatformSetup {
+	return &bsdSetup{}
+}
+
+func (b *bsdSetup) SetupLink(ifaceName string, mtu int) error {
+	b.ifaceName = ifaceName
+	return runCmd("ifconfig", ifaceName, "mtu", fmt.Sprintf("%d", mtu), "up")
+}
+
+func (b *bsdSetup) SetupAddr(ifaceName, addr, peer string) error {
+	b.ifaceName = ifaceName
+	if peer != "" {
+		return runCmd("ifconfig", ifaceName, addr, peer)
+	}
+	return runCmd("ifconfig", ifaceName, addr, addr)
+}
+
+func (b *bsdSetup) AddRoute(dst *net.IPNet, gw net.IP, table int) error {
+	if err := runCmd("route", "add", "-net", dst.String(), gw.String()); err != nil {
+		return err
+	}
+	b.routes = append(b.routes, dst)
+	return nil
+}
+
+func (b *bsdSetup) PinRemoteHost(addr string) error {
+	ta, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	gw, err := defaultGateway(ta.IP)
+	if err != nil {
+		return err
+	}
+
+	b.remoteAddr = addr
+	return runCmd("route", "add", "-host", ta.IP.String(), gw.String())
+}
+
+// InstallNAT loads a pf anchor that masquerades traffic from iface through
+// egress, mirroring setup_darwin.go's approach so it coexists with whatever
+// other pf rules the host already has loaded.
+func (b *bsdSetup) InstallNAT(iface, egress string) error {
+	rules := fmt.Sprintf("nat on %s from %s:network to any -> (%s)\n", egress, iface, egress)
+	cmd := exec.Command("pfctl", "-a", bsdPfAnchor, "-f", "-")
+	cmd.Stdin = strings.NewReader(rules)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pfctl -a %s -f -: %s: %s", bsdPfAnchor, err, out)
+	}
+	if err := runCmd("pfctl", "-a", bsdPfAnchor, "-E"); err != nil {
+		return err
+	}
+	b.natLoaded = true
+	return nil
+}
+
+func (b *bsdSetup) Teardown() error {
+	if b.natLoaded {
+		if err := runCmd("pfctl", "-a", bsdPfAnchor, "-F", "all"); err != nil {
+			return err
+		}
+	}
+
+	for _, dst := range b.routes {
+		if err := runCmd("route", "delete", "-net", dst.String()); err != nil {
+			return err
+		}
+	}
+	b.routes = nil
+
+	if b.remoteAddr != "" {
+		ta, err := net.ResolveTCPAddr("tcp", b.remoteAddr)
+		if err != nil {
+			return err
+		}
+		if err := runCmd("route", "delete", "-host", ta.IP.String()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+// +build darwin freebsd openbsd netbsd dragonfly
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// This file holds the ifconfig/route helpers shared by setup_darwin.go and
+// setup_bsd.go, since Darwin's network stack is itself a BSD derivative and
+// both drive the same command-line tools.
+
+func runCmd(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %v: %s: %s", name, args, err, out)
+	}
+	return nil
+}
+
+// defaultGateway shells out to `route get` to find the gateway the kernel
+// would currently use to reach dst, so PinRemoteHost can pin a host route
+// to the remote server through it before the tunnel's routes are added.
+func defaultGateway(dst net.IP) (net.IP, error) {
+	out, err := exec.Command("route", "-n", "get", dst.String()).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("route -n get %s: %s: %s", dst, err, out)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "gateway:" {
+			gw := net.ParseIP(fields[1])
+			if gw == nil {
+				return nil, fmt.Errorf("route -n get %s: unparsable gateway %q", dst, fields[1])
+			}
+			return gw, nil
+		}
+	}
+	return nil, fmt.Errorf("route -n get %s: no gateway line in output", dst)
+}
@@ -0,0 +1,113 @@
+// +build darwin
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"./pinlib"
+)
+
+// This file implements pinlib.PlatformSetup for macOS using ifconfig/route
+// for links, addresses and routes, and pfctl with a dedicated anchor for
+// NAT, since Darwin has neither netlink nor iptables. The ifconfig/route
+// helpers it shares with setup_bsd.go live in setup_bsdcommon.go.
+
+const pfAnchor = "pin"
+
+// darwinSetup implements pinlib.PlatformSetup for macOS.
+type darwinSetup struct {
+	ifaceName  string
+	remoteAddr string
+	routes     []*net.IPNet
+	natLoaded  bool
+}
+
+// NewDarwinSetup returns a pinlib.PlatformSetup backed by ifconfig, route
+// and pfctl.
+func NewDarwinSetup() pinlib.PlatformSetup {
+	return &darwinSetup{}
+}
+
+func (d *darwinSetup) SetupLink(ifaceName string, mtu int) error {
+	d.ifaceName = ifaceName
+	return runCmd("ifconfig", ifaceName, "mtu", fmt.Sprintf("%d", mtu), "up")
+}
+
+func (d *darwinSetup) SetupAddr(ifaceName, addr, peer string) error {
+	d.ifaceName = ifaceName
+	if peer != "" {
+		return runCmd("ifconfig", ifaceName, addr, peer)
+	}
+	return runCmd("ifconfig", ifaceName, addr, addr)
+}
+
+func (d *darwinSetup) AddRoute(dst *net.IPNet, gw net.IP, table int) error {
+	if err := runCmd("route", "-n", "add", "-net", dst.String(), gw.String()); err != nil {
+		return err
+	}
+	d.routes = append(d.routes, dst)
+	return nil
+}
+
+func (d *darwinSetup) PinRemoteHost(addr string) error {
+	ta, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	gw, err := defaultGateway(ta.IP)
+	if err != nil {
+		return err
+	}
+
+	d.remoteAddr = addr
+	return runCmd("route", "-n", "add", "-host", ta.IP.String(), gw.String())
+}
+
+// InstallNAT loads a pf anchor that masquerades traffic from iface through
+// egress, so it coexists with whatever other pf rules the host already has
+// loaded instead of replacing pf.conf wholesale.
+func (d *darwinSetup) InstallNAT(iface, egress string) error {
+	rules := fmt.Sprintf("nat on %s from %s:network to any -> (%s)\n", egress, iface, egress)
+	cmd := exec.Command("pfctl", "-a", pfAnchor, "-f", "-")
+	cmd.Stdin = strings.NewReader(rules)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pfctl -a %s -f -: %s: %s", pfAnchor, err, out)
+	}
+	if err := runCmd("pfctl", "-a", pfAnchor, "-E"); err != nil {
+		return err
+	}
+	d.natLoaded = true
+	return nil
+}
+
+func (d *darwinSetup) Teardown() error {
+	if d.natLoaded {
+		if err := runCmd("pfctl", "-a", pfAnchor, "-F", "all"); err != nil {
+			return err
+		}
+	}
+
+	for _, dst := range d.routes {
+		if err := runCmd("route", "-n", "delete", "-net", dst.String()); err != nil {
+			return err
+		}
+	}
+	d.routes = nil
+
+	if d.remoteAddr != "" {
+		ta, err := net.ResolveTCPAddr("tcp", d.remoteAddr)
+		if err != nil {
+			return err
+		}
+		if err := runCmd("route", "-n", "delete", "-host", ta.IP.String()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -6,15 +6,64 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"os/exec"
 	"strings"
 
 	"./pinlib"
+	"./pinlib/netstate"
+	"github.com/coreos/go-iptables/iptables"
 	"github.com/vishvananda/netlink"
 )
 
-// This file mainly contains helper functions for client and server side setup after the
-// handshake connection is established
+// This file implements pinlib.PlatformSetup for Linux using netlink for
+// links/addresses/routes and go-iptables for NAT and firewalling. It also
+// exposes Linux-only extras (firewall policy, fwmark policy routing) beyond
+// the cross-platform interface, for main to opt into when it knows it's
+// running on Linux.
+
+const (
+	ipv4ProbeAddr = "8.8.8.8:53"
+	ipv6ProbeAddr = "[2001:4860:4860::8888]:53"
+)
+
+const (
+	// pinFromMark marks traffic bound for pin's own remote endpoint (its
+	// control/data connection to the server), so AddPolicyRouting's rule can
+	// exclude it from the tunnel's routing table instead of looping into it.
+	pinFromMark = 0x40000
+	// pinRouteTable is the dedicated routing table used for policy routing,
+	// keeping pin's routes out of the main table so it can coexist with
+	// other VPNs on the same host.
+	pinRouteTable = 52
+)
+
+const (
+	// pinForwardChain and pinNATChain hold every FORWARD/POSTROUTING rule
+	// pin installs. Traffic reaches them via a single jump rule inserted
+	// into the built-in chain, so Teardown can flush and delete just these
+	// two chains instead of hunting down individual rules in FORWARD/
+	// POSTROUTING, and other firewall rules on the host are left alone.
+	pinForwardChain = "PIN-FORWARD"
+	pinNATChain     = "PIN-NAT"
+)
+
+// linuxSetup implements pinlib.PlatformSetup for Linux, tracking the routes,
+// addresses and tun name it has set up so Teardown can undo them.
+type linuxSetup struct {
+	ifaceName         string
+	remoteAddr        string
+	remoteIP          net.IP
+	routes            []*netlink.Route
+	policy            *pinlib.FirewallPolicy
+	policyRoutingUsed bool
+	tunIsIPv6         bool
+	netState          *netstate.NetState
+}
+
+// NewLinuxSetup returns a pinlib.PlatformSetup backed by netlink and
+// go-iptables.
+func NewLinuxSetup() pinlib.PlatformSetup {
+	return &linuxSetup{}
+}
 
 func getDefaultRoutes(addr string) ([]netlink.Route, error) {
 	ipaddr, err := net.ResolveTCPAddr("tcp", addr)
@@ -35,8 +84,15 @@ func getDefaultGateway(addr string) (net.IP, error) {
 	return routes[0].Gw, nil
 }
 
-func getDefaultLinkDevIndex() (int, error) {
-	routes, err := getDefaultRoutes("8.8.8.8:53")
+// getDefaultLinkDevIndex returns the link index of the default route for the
+// given address family. Pass netlink.FAMILY_V4 or netlink.FAMILY_V6.
+func getDefaultLinkDevIndex(family int) (int, error) {
+	probe := ipv4ProbeAddr
+	if family == netlink.FAMILY_V6 {
+		probe = ipv6ProbeAddr
+	}
+
+	routes, err := getDefaultRoutes(probe)
 	if err != nil {
 		return -1, err
 	}
@@ -47,7 +103,7 @@ func getDefaultLinkDevIndex() (int, error) {
 	return routes[0].LinkIndex, nil
 }
 
-func SkipRemoteRouting(addr string) error {
+func (l *linuxSetup) PinRemoteHost(addr string) error {
 	gw, err := getDefaultGateway(addr)
 	if err != nil {
 		return err
@@ -58,51 +114,32 @@ func SkipRemoteRouting(addr string) error {
 		return err
 	}
 
-	err = netlink.RouteAdd(&netlink.Route{
-		Dst: &net.IPNet{
-			IP:   ta.IP,
-			Mask: net.IPv4Mask(255, 255, 255, 255),
-		},
-		Gw: gw,
-	})
+	route := &netlink.Route{
+		Dst: &net.IPNet{IP: ta.IP, Mask: hostMask(ta.IP)},
+		Gw:  gw,
+	}
 
-	if err != nil {
+	if err := netlink.RouteAdd(route); err != nil {
 		if !os.IsExist(err) {
 			return err
 		}
 	}
 
+	l.remoteAddr = addr
+	l.remoteIP = ta.IP
 	return nil
 }
 
-func SetupRoutes(remotegw string) error {
-	gw, err := net.ResolveIPAddr("ip4", remotegw)
-	if err != nil {
-		return err
-	}
-	err = netlink.RouteAdd(&netlink.Route{
-		Dst: &net.IPNet{
-			IP:   []byte{0, 0, 0, 0},
-			Mask: net.IPv4Mask(128, 0, 0, 0),
-		},
-		Gw: gw.IP,
-	})
-
-	if err != nil {
+func (l *linuxSetup) AddRoute(dst *net.IPNet, gw net.IP, table int) error {
+	route := &netlink.Route{Dst: dst, Gw: gw, Table: table}
+	if err := netlink.RouteAdd(route); err != nil {
 		return err
 	}
-
-	return netlink.RouteAdd(&netlink.Route{
-		Dst: &net.IPNet{
-			IP:   []byte{128, 0, 0, 0},
-			Mask: net.IPv4Mask(128, 0, 0, 0),
-		},
-		Gw: gw.IP,
-	})
+	l.routes = append(l.routes, route)
+	return nil
 }
 
-func SetupAddr(ifaceName string, ifaceAddr string, remotegw string) error {
-	// get the link holder
+func (l *linuxSetup) SetupAddr(ifaceName string, ifaceAddr string, remotegw string) error {
 	link, err := netlink.LinkByName(ifaceName)
 	if err != nil {
 		return err
@@ -114,103 +151,397 @@ func SetupAddr(ifaceName string, ifaceAddr string, remotegw string) error {
 	}
 
 	if remotegw != "" {
+		network := "ip4"
+		if strings.Contains(remotegw, ":") {
+			network = "ip6"
+		}
 
-		ipaddr, err := net.ResolveIPAddr("ip4", remotegw)
+		ipaddr, err := net.ResolveIPAddr(network, remotegw)
 		if err != nil {
 			return err
 		}
-		addr.Peer = &net.IPNet{IP: ipaddr.IP, Mask: net.IPv4Mask(255, 255, 255, 255)}
-
+		addr.Peer = &net.IPNet{IP: ipaddr.IP, Mask: hostMask(ipaddr.IP)}
 	}
+
+	l.ifaceName = ifaceName
+	l.tunIsIPv6 = isIPv6(addr.IP)
 	return netlink.AddrAdd(link, addr)
 }
 
-func SetupLink(ifaceName string) error {
-	// get the link holder
-	link, err := netlink.LinkByName(ifaceName)
+func (l *linuxSetup) SetupLink(ifaceName string, mtu int) error {
+	state, err := netstate.Capture(ifaceName)
 	if err != nil {
 		return err
 	}
+	l.netState = state
 
-	// set the mtu
-	err = netlink.LinkSetMTU(link, 1500)
+	link, err := netlink.LinkByName(ifaceName)
 	if err != nil {
 		return err
 	}
 
-	// activate it
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return err
+	}
+
+	l.ifaceName = ifaceName
 	return netlink.LinkSetUp(link)
+}
+
+func newIPTables(proto iptables.Protocol) (*iptables.IPTables, error) {
+	return iptables.New(iptables.IPFamily(proto), iptables.Timeout(5))
+}
+
+func linkDevFamilyFor(proto iptables.Protocol) int {
+	if proto == iptables.ProtocolIPv6 {
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_V4
+}
+
+func commandNameFor(proto iptables.Protocol) string {
+	if proto == iptables.ProtocolIPv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func protocolFor(ip net.IP) iptables.Protocol {
+	if isIPv6(ip) {
+		return iptables.ProtocolIPv6
+	}
+	return iptables.ProtocolIPv4
+}
+
+func cidrsForFamily(cidrs []*net.IPNet, proto iptables.Protocol) []*net.IPNet {
+	var out []*net.IPNet
+	for _, cidr := range cidrs {
+		if isIPv6(cidr.IP) == (proto == iptables.ProtocolIPv6) {
+			out = append(out, cidr)
+		}
+	}
+	return out
+}
+
+type tableRule struct {
+	table, chain string
+	spec         []string
+}
+
+// pinChainRules returns, in priority order, the rules that go inside
+// pinForwardChain/pinNATChain for ifaceName under policy. Being isolated in
+// pin's own chains (rather than FORWARD/POSTROUTING directly) means
+// Teardown can just flush and delete these two chains instead of matching
+// individual rules against whatever else is in the built-in chains.
+func pinChainRules(ifaceName, egress string, proto iptables.Protocol, policy *pinlib.FirewallPolicy) []tableRule {
+	var rules []tableRule
+	var allowed []*net.IPNet
+	whitelisting := policy != nil && len(policy.AllowedCIDRs) > 0
+
+	if policy != nil {
+		if policy.EgressInterface != "" {
+			egress = policy.EgressInterface
+		}
+		if policy.ClientIsolation {
+			rules = append(rules, tableRule{"filter", pinForwardChain, []string{"-i", ifaceName, "-o", ifaceName, "-j", "DROP"}})
+		}
+		for _, cidr := range cidrsForFamily(policy.DeniedCIDRs, proto) {
+			rules = append(rules, tableRule{"filter", pinForwardChain, []string{"-i", ifaceName, "-d", cidr.String(), "-j", "DROP"}})
+		}
+		allowed = cidrsForFamily(policy.AllowedCIDRs, proto)
+		for _, cidr := range allowed {
+			rules = append(rules, tableRule{"filter", pinForwardChain, []string{"-i", ifaceName, "-d", cidr.String(), "-j", "ACCEPT"}})
+		}
+	}
+
+	// A blanket ACCEPT here would make the per-CIDR ACCEPTs above a no-op,
+	// since every destination not caught by DeniedCIDRs would already be let
+	// through. Only install it when AllowedCIDRs isn't acting as a
+	// whitelist; otherwise terminate the chain with a DROP so only the
+	// allowed destinations are reachable. Checking policy.AllowedCIDRs
+	// itself rather than the family-filtered allowed keeps a whitelist that
+	// simply has no entries for this address family from failing open.
+	if !whitelisting {
+		rules = append(rules, tableRule{"filter", pinForwardChain, []string{"-i", ifaceName, "-j", "ACCEPT"}})
+	} else {
+		rules = append(rules, tableRule{"filter", pinForwardChain, []string{"-i", ifaceName, "-j", "DROP"}})
+	}
+	rules = append(rules, tableRule{"filter", pinForwardChain, []string{"-o", ifaceName, "-j", "ACCEPT"}})
 
+	if policy == nil || !policy.NoMasquerade {
+		for _, cidr := range allowed {
+			rules = append(rules, tableRule{"nat", pinNATChain, []string{"-d", cidr.String(), "-j", "ACCEPT"}})
+		}
+		rules = append(rules, tableRule{"nat", pinNATChain, []string{"-o", egress, "-j", "MASQUERADE"}})
+	}
+
+	return rules
 }
 
-func SetupIPTables(ifaceName string) error {
-	// iptables -F
-	cmd, err := findExecutablePath("iptables")
+func openIPTables(proto iptables.Protocol) (*iptables.IPTables, string, error) {
+	ipt, err := newIPTables(proto)
 	if err != nil {
-		return fmt.Errorf("probably iptables command is missing from your system (?) or not found in the $PATH, make sure it is available : %s", err)
+		return nil, "", fmt.Errorf("probably %s is missing from your system (?) or not found in the $PATH, make sure it is available : %s", commandNameFor(proto), err)
 	}
 
-	ix, err := getDefaultLinkDevIndex()
+	ix, err := getDefaultLinkDevIndex(linkDevFamilyFor(proto))
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
 	link, err := netlink.LinkByIndex(ix)
 	if err != nil {
+		return nil, "", err
+	}
+
+	return ipt, link.Attrs().Name, nil
+}
+
+// ensurePinChains makes sure pinForwardChain/pinNATChain exist and are
+// empty, and that FORWARD/POSTROUTING jump into them. ClearChain creates
+// the chain if missing and flushes it otherwise, so this is safe to call
+// every time setupIPTablesFor runs.
+func ensurePinChains(ipt *iptables.IPTables) error {
+	if err := ipt.ClearChain("filter", pinForwardChain); err != nil {
+		return err
+	}
+	if err := ipt.ClearChain("nat", pinNATChain); err != nil {
+		return err
+	}
+	if err := ipt.AppendUnique("filter", "FORWARD", "-j", pinForwardChain); err != nil {
 		return err
 	}
+	return ipt.AppendUnique("nat", "POSTROUTING", "-j", pinNATChain)
+}
 
-	cmds := [][]string{
-		{"-F"},                                                                          // Flush any old rules
-		{"-F", "-t", "nat"},                                                             // Flush the same for the NAT table
-		{"-I", "FORWARD", "-i", ifaceName, "-j", "ACCEPT"},                              // Accept all input packets from "interface" in the FORWARD chain
-		{"-I", "FORWARD", "-o", ifaceName, "-j", "ACCEPT"},                              // Accept all output packets from "interface" in the FORWARD chain
-		{"-I", "INPUT", "-i", ifaceName, "-j", "ACCEPT"},                                // Accept all output packets from "interface" in the INPUT chain
-		{"-t", "nat", "-I", "POSTROUTING", "-o", link.Attrs().Name, "-j", "MASQUERADE"}, // It says what it does ;)
+func setupIPTablesFor(proto iptables.Protocol, ifaceName string, policy *pinlib.FirewallPolicy) error {
+	ipt, egress, err := openIPTables(proto)
+	if err != nil {
+		return err
 	}
 
-	for _, cx := range cmds {
-		fmt.Println("running command : ", strings.Join(append([]string{cmd}, cx...), " "))
-		err := exec.Command(cmd, cx...).Start()
-		if err != nil {
-			return fmt.Errorf("Error while running iptables : %s", err)
+	if err := ensurePinChains(ipt); err != nil {
+		return err
+	}
+
+	if err := ipt.AppendUnique("filter", "INPUT", "-i", ifaceName, "-j", "ACCEPT"); err != nil {
+		return fmt.Errorf("Error while installing %s rule in filter/INPUT : %s", commandNameFor(proto), err)
+	}
+
+	for _, r := range pinChainRules(ifaceName, egress, proto, policy) {
+		if err := ipt.Append(r.table, r.chain, r.spec...); err != nil {
+			return fmt.Errorf("Error while installing %s rule in %s/%s : %s", commandNameFor(proto), r.table, r.chain, err)
 		}
 	}
 
 	return nil
 }
 
-func SetupClient(client *pinlib.Client, addr, ifaceName, tunaddr, gw string) {
-	client.Hook = func() error {
-		err := SkipRemoteRouting(addr)
-		if err != nil {
+// teardownIPTablesFor removes the INPUT ACCEPT rule, flushes and deletes
+// pinForwardChain/pinNATChain, and removes the jump rules that pointed to
+// them, undoing setupIPTablesFor without touching any other rule on the
+// host.
+func teardownIPTablesFor(proto iptables.Protocol, ifaceName string) error {
+	ipt, err := newIPTables(proto)
+	if err != nil {
+		return fmt.Errorf("probably %s is missing from your system (?) or not found in the $PATH, make sure it is available : %s", commandNameFor(proto), err)
+	}
+
+	if exists, err := ipt.Exists("filter", "INPUT", "-i", ifaceName, "-j", "ACCEPT"); err != nil {
+		return err
+	} else if exists {
+		if err := ipt.Delete("filter", "INPUT", "-i", ifaceName, "-j", "ACCEPT"); err != nil {
 			return err
 		}
+	}
 
-		err = SetupLink(ifaceName)
-		if err != nil {
+	if exists, err := ipt.Exists("filter", "FORWARD", "-j", pinForwardChain); err != nil {
+		return err
+	} else if exists {
+		if err := ipt.Delete("filter", "FORWARD", "-j", pinForwardChain); err != nil {
+			return err
+		}
+	}
+	if exists, err := ipt.Exists("nat", "POSTROUTING", "-j", pinNATChain); err != nil {
+		return err
+	} else if exists {
+		if err := ipt.Delete("nat", "POSTROUTING", "-j", pinNATChain); err != nil {
 			return err
 		}
+	}
 
-		err = SetupAddr(ifaceName, tunaddr, gw)
-		if err != nil {
+	if exists, err := ipt.ChainExists("filter", pinForwardChain); err != nil {
+		return err
+	} else if exists {
+		if err := ipt.ClearAndDeleteChain("filter", pinForwardChain); err != nil {
+			return err
+		}
+	}
+	if exists, err := ipt.ChainExists("nat", pinNATChain); err != nil {
+		return err
+	} else if exists {
+		if err := ipt.ClearAndDeleteChain("nat", pinNATChain); err != nil {
 			return err
 		}
+	}
 
-		return SetupRoutes(gw)
+	return nil
+}
+
+// InstallNAT installs the FORWARD/INPUT/MASQUERADE rules for iface, egress
+// through egress (or the default uplink's interface if egress is empty).
+// The v4 or v6 ruleset is chosen to match the tun address SetupAddr set up,
+// so a v4-only host isn't required to have ip6tables installed (and vice
+// versa). Call ApplyFirewallPolicy first to shape the ruleset beyond
+// accept-all.
+func (l *linuxSetup) InstallNAT(iface, egress string) error {
+	if egress != "" && l.policy == nil {
+		l.policy = &pinlib.FirewallPolicy{EgressInterface: egress}
+	}
+
+	proto := iptables.ProtocolIPv4
+	if l.tunIsIPv6 {
+		proto = iptables.ProtocolIPv6
+	}
+	if err := setupIPTablesFor(proto, iface, l.policy); err != nil {
+		return err
 	}
+
+	l.ifaceName = iface
+	return nil
 }
 
-func SetupServer(server *pinlib.Server, ifaceName, tunaddr string) error {
-	err := SetupLink(ifaceName)
-	if err != nil {
+// ApplyFirewallPolicy records policy so a subsequent InstallNAT (or
+// Teardown) translates it into concrete FORWARD/POSTROUTING rules. It is a
+// Linux-only extra beyond pinlib.PlatformSetup.
+func (l *linuxSetup) ApplyFirewallPolicy(policy *pinlib.FirewallPolicy) error {
+	l.policy = policy
+	if l.ifaceName == "" {
+		return nil
+	}
+	return l.InstallNAT(l.ifaceName, policy.EgressInterface)
+}
+
+// EnablePolicyRouting marks pin's own remote connection with pinFromMark in
+// the mangle table and adds an ip rule that diverts everything else into
+// pinRouteTable, so pin's tunnel routes don't have to live in the main table
+// and pin's own traffic doesn't loop into the tunnel it's setting up. It is
+// a Linux-only extra beyond pinlib.PlatformSetup.
+func (l *linuxSetup) EnablePolicyRouting() error {
+	if err := markPackets(protocolFor(l.remoteIP), l.remoteIP, true); err != nil {
+		return err
+	}
+	if err := AddPolicyRouting(pinRouteTable, pinFromMark); err != nil {
 		return err
 	}
+	l.policyRoutingUsed = true
+	return nil
+}
 
-	err = SetupAddr(ifaceName, tunaddr, "")
+// PolicyRouteTable returns the routing table EnablePolicyRouting diverts
+// marked traffic into, so callers can route tunnel traffic there with
+// AddRoute instead of the main table. It is a Linux-only extra beyond
+// pinlib.PlatformSetup.
+func (l *linuxSetup) PolicyRouteTable() int {
+	return pinRouteTable
+}
+
+// markPackets sets or clears the mangle OUTPUT rule that marks traffic
+// bound for remoteIP (pin's own remote endpoint) with pinFromMark. That
+// traffic always egresses the physical uplink rather than ifaceName, so it
+// has to be matched by destination rather than by tun ingress/egress.
+func markPackets(proto iptables.Protocol, remoteIP net.IP, set bool) error {
+	ipt, err := newIPTables(proto)
+	if err != nil {
+		return fmt.Errorf("probably %s is missing from your system (?) or not found in the $PATH, make sure it is available : %s", commandNameFor(proto), err)
+	}
+
+	r := tableRule{"mangle", "OUTPUT", []string{"-d", remoteIP.String(), "-j", "MARK", "--set-mark", fmt.Sprintf("%#x", pinFromMark)}}
+
+	exists, err := ipt.Exists(r.table, r.chain, r.spec...)
 	if err != nil {
 		return err
 	}
+	if set {
+		if exists {
+			return nil
+		}
+		return ipt.Insert(r.table, r.chain, 1, r.spec...)
+	}
+	if !exists {
+		return nil
+	}
+	return ipt.Delete(r.table, r.chain, r.spec...)
+}
+
+// AddPolicyRouting adds an `ip rule` that sends traffic NOT carrying mark
+// into table instead of the main routing table, mirroring the wireguard/
+// tailscale pattern: everything except pin's own marked remote connection
+// (see markPackets) is diverted, so pin's tunnel routes can live in table
+// without fighting other VPNs over the main one.
+func AddPolicyRouting(table int, mark uint32) error {
+	rule := netlink.NewRule()
+	rule.Table = table
+	rule.Mark = int(mark)
+	rule.Invert = true
+	return netlink.RuleAdd(rule)
+}
+
+// RemovePolicyRouting removes the `ip rule` AddPolicyRouting installed.
+func RemovePolicyRouting(table int, mark uint32) error {
+	rule := netlink.NewRule()
+	rule.Table = table
+	rule.Mark = int(mark)
+	rule.Invert = true
+	return netlink.RuleDel(rule)
+}
+
+// Teardown removes every route, address, NAT/firewall rule and policy
+// routing entry this linuxSetup installed.
+func (l *linuxSetup) Teardown() error {
+	proto := iptables.ProtocolIPv4
+	if l.tunIsIPv6 {
+		proto = iptables.ProtocolIPv6
+	}
+
+	if l.policyRoutingUsed {
+		if err := RemovePolicyRouting(pinRouteTable, pinFromMark); err != nil {
+			return err
+		}
+		if err := markPackets(protocolFor(l.remoteIP), l.remoteIP, false); err != nil {
+			return err
+		}
+	}
+
+	if l.ifaceName != "" {
+		if err := teardownIPTablesFor(proto, l.ifaceName); err != nil {
+			return err
+		}
+	}
+
+	for _, route := range l.routes {
+		if err := netlink.RouteDel(route); err != nil {
+			return err
+		}
+	}
+	l.routes = nil
 
-	return SetupIPTables(ifaceName)
+	if l.remoteAddr != "" {
+		ta, err := net.ResolveTCPAddr("tcp", l.remoteAddr)
+		if err != nil {
+			return err
+		}
+		route := &netlink.Route{Dst: &net.IPNet{IP: ta.IP, Mask: hostMask(ta.IP)}}
+		if err := netlink.RouteDel(route); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if l.netState != nil {
+		if err := l.netState.Restore(); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
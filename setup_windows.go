@@ -0,0 +1,187 @@
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"./pinlib"
+)
+
+// This file implements pinlib.PlatformSetup for Windows using
+// `netsh interface ip` for links/addresses/routes and the Routing and
+// Remote Access service (RRAS) for NAT, since Windows has neither netlink
+// nor iptables/pf. RRAS is configured once via `netsh routing ip nat`
+// rather than per-call WFP filters, to keep this in line with how the
+// other platforms install one NAT ruleset per tun interface.
+
+// windowsSetup implements pinlib.PlatformSetup for Windows.
+type windowsSetup struct {
+	ifaceName    string
+	remoteAddr   string
+	routes       []*net.IPNet
+	natInstalled bool
+	natEgress    string
+}
+
+// NewWindowsSetup returns a pinlib.PlatformSetup backed by netsh and RRAS.
+func NewWindowsSetup() pinlib.PlatformSetup {
+	return &windowsSetup{}
+}
+
+func netsh(args ...string) error {
+	out, err := exec.Command("netsh", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("netsh %v: %s: %s", args, err, out)
+	}
+	return nil
+}
+
+func (w *windowsSetup) SetupLink(ifaceName string, mtu int) error {
+	w.ifaceName = ifaceName
+	return netsh("interface", "ipv4", "set", "subinterface", ifaceName,
+		fmt.Sprintf("mtu=%d", mtu), "store=active")
+}
+
+func (w *windowsSetup) SetupAddr(ifaceName, addr, peer string) error {
+	w.ifaceName = ifaceName
+
+	ip, ipnet, err := net.ParseCIDR(addr)
+	if err != nil {
+		return err
+	}
+	mask := net.IP(ipnet.Mask).String()
+
+	return netsh("interface", "ip", "set", "address", ifaceName, "static", ip.String(), mask)
+}
+
+func (w *windowsSetup) AddRoute(dst *net.IPNet, gw net.IP, table int) error {
+	if err := netsh("interface", "ip", "add", "route", dst.String(), w.ifaceName, gw.String()); err != nil {
+		return err
+	}
+	w.routes = append(w.routes, dst)
+	return nil
+}
+
+// defaultGatewayAndInterface parses the "0.0.0.0  0.0.0.0  <gw>  <local-ip>  <metric>"
+// line out of `route print 0.0.0.0`, then resolves the local IP in that line
+// back to its interface name via interfaceNameForIP.
+func defaultGatewayAndInterface() (gw net.IP, ifaceName string, err error) {
+	out, err := exec.Command("route", "print", "0.0.0.0").CombinedOutput()
+	if err != nil {
+		return nil, "", fmt.Errorf("route print 0.0.0.0: %s: %s", err, out)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 5 || fields[0] != "0.0.0.0" || fields[1] != "0.0.0.0" {
+			continue
+		}
+		routeGw := net.ParseIP(fields[2])
+		localIP := net.ParseIP(fields[3])
+		if routeGw == nil || localIP == nil {
+			continue
+		}
+		iface, err := interfaceNameForIP(localIP)
+		if err != nil {
+			return nil, "", err
+		}
+		return routeGw, iface, nil
+	}
+
+	return nil, "", fmt.Errorf("route print 0.0.0.0: no default route found")
+}
+
+// interfaceNameForIP finds the Windows interface currently configured with
+// ip, by scanning `netsh interface ip show config`.
+func interfaceNameForIP(ip net.IP) (string, error) {
+	out, err := exec.Command("netsh", "interface", "ip", "show", "config").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("netsh interface ip show config: %s: %s", err, out)
+	}
+
+	var current string
+	for _, line := range strings.Split(string(out), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "Configuration for interface") {
+			current = strings.Trim(strings.TrimPrefix(trimmed, "Configuration for interface"), " \"")
+			continue
+		}
+		if strings.Contains(trimmed, "IP Address") && strings.Contains(trimmed, ip.String()) {
+			return current, nil
+		}
+	}
+
+	return "", fmt.Errorf("no interface found with address %s", ip)
+}
+
+func (w *windowsSetup) PinRemoteHost(addr string) error {
+	ta, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	gw, egressIface, err := defaultGatewayAndInterface()
+	if err != nil {
+		return err
+	}
+	w.natEgress = egressIface
+
+	w.remoteAddr = addr
+	return netsh("interface", "ip", "add", "route",
+		ta.IP.String()+"/32", egressIface, gw.String())
+}
+
+// InstallNAT enables RRAS NAT on egress (or the interface PinRemoteHost
+// detected as the physical uplink), so traffic arriving on iface is
+// translated when it leaves the host.
+func (w *windowsSetup) InstallNAT(iface, egress string) error {
+	if egress == "" {
+		egress = w.natEgress
+	}
+	if err := netsh("routing", "ip", "nat", "install"); err != nil {
+		return err
+	}
+	if err := netsh("routing", "ip", "nat", "add", "interface", egress, "full"); err != nil {
+		return err
+	}
+	if err := netsh("routing", "ip", "nat", "add", "interface", iface, "private"); err != nil {
+		return err
+	}
+	w.natInstalled = true
+	w.natEgress = egress
+	return nil
+}
+
+func (w *windowsSetup) Teardown() error {
+	if w.natInstalled {
+		if err := netsh("routing", "ip", "nat", "delete", "interface", w.ifaceName); err != nil {
+			return err
+		}
+		if err := netsh("routing", "ip", "nat", "delete", "interface", w.natEgress); err != nil {
+			return err
+		}
+	}
+
+	for _, dst := range w.routes {
+		if err := netsh("interface", "ip", "delete", "route", dst.String(), w.ifaceName); err != nil {
+			return err
+		}
+	}
+	w.routes = nil
+
+	if w.remoteAddr != "" {
+		ta, err := net.ResolveTCPAddr("tcp", w.remoteAddr)
+		if err != nil {
+			return err
+		}
+		if err := netsh("interface", "ip", "delete", "route", ta.IP.String()+"/32", w.natEgress); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}